@@ -27,164 +27,2621 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/tabwriter"
 	"time"
+	"unicode"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"golang.org/x/time/rate"
+	"gopkg.in/yaml.v2"
 )
 
+// requestMetrics are the S3 request metrics that we collect, for buckets
+// that have request metrics enabled.
+var requestMetrics = map[string]bool{
+	"AllRequests":     true,
+	"GetRequests":     true,
+	"PutRequests":     true,
+	"4xxErrors":       true,
+	"5xxErrors":       true,
+	"BytesDownloaded": true,
+	"BytesUploaded":   true,
+}
+
+// metric is a single collected value. Storage is set for storage metrics,
+// Filter for request metrics and Rule for replication metrics. Stat is the
+// statistic, for metrics that are reported as more than one.
+type metric struct {
+	Region    string  `json:"region"`
+	Bucket    string  `json:"bucket"`
+	Storage   string  `json:"storage,omitempty"`
+	Filter    string  `json:"filter,omitempty"`
+	Rule      string  `json:"rule,omitempty"`
+	Name      string  `json:"metric"`
+	Stat      string  `json:"stat,omitempty"`
+	Value     float64 `json:"value"`
+	Timestamp int64   `json:"timestamp"`
+
+	path string // graphite path, including the prefix
+}
+
+// metricUnits are the units that the S3 metrics are published with.
+var metricUnits = map[string]string{
+	"BucketSizeBytes":         "Bytes",
+	"NumberOfObjects":         "Count",
+	"AllRequests":             "Count",
+	"GetRequests":             "Count",
+	"PutRequests":             "Count",
+	"4xxErrors":               "Count",
+	"5xxErrors":               "Count",
+	"BytesDownloaded":         "Bytes",
+	"BytesUploaded":           "Bytes",
+	"FirstByteLatency":        "Milliseconds",
+	"TotalRequestLatency":     "Milliseconds",
+	"ReplicationLatency":      "Seconds",
+	"BytesPendingReplication": "Bytes",
+}
+
+// latencyMetrics are the S3 request metrics that measure latency, which are
+// reported as an average and as percentiles.
+var latencyMetrics = map[string]bool{
+	"FirstByteLatency":    true,
+	"TotalRequestLatency": true,
+}
+
+// replicationMetrics are the S3 replication metrics that we collect, for
+// each replication rule, along with the statistic to use for each.
+var replicationMetrics = map[string]string{
+	"ReplicationLatency":      "Maximum",
+	"BytesPendingReplication": "Average",
+}
+
+// metricName returns the name we report a CloudWatch metric as.
+func metricName(name string) string {
+	switch name {
+	case "BucketSizeBytes":
+		return "size"
+	case "NumberOfObjects":
+		return "objcount"
+	}
+	return strings.ToLower(name)
+}
+
+// supportedMetrics returns the names of all the metrics that we collect.
+func supportedMetrics() []string {
+	names := []string{"size", "objcount"}
+	for name := range requestMetrics {
+		names = append(names, metricName(name))
+	}
+	for name := range latencyMetrics {
+		names = append(names, metricName(name))
+	}
+	for name := range replicationMetrics {
+		names = append(names, metricName(name))
+	}
+	sort.Strings(names[2:])
+	return names
+}
+
+// sizeUnits are the units that the -size-unit can be, in bytes.
+var sizeUnits = map[string]float64{
+	"kb": 1 << 10,
+	"mb": 1 << 20,
+	"gb": 1 << 30,
+	"tb": 1 << 40,
+}
+
+// storageTypes maps the lowercased CloudWatch storage types to the names we
+// report them as.
+var storageTypes = map[string]string{
+	"allstoragetypes":                "all",
+	"standardstorage":                "standard",
+	"standardiastorage":              "standard_ia",
+	"standardiasizeoverhead":         "standard_ia_overhead",
+	"reducedredundancystorage":       "rrs",
+	"onezoneiastorage":               "onezone_ia",
+	"onezoneiasizeoverhead":          "onezone_ia_overhead",
+	"intelligenttieringstorage":      "intelligent_tiering",
+	"intelligenttieringfastorage":    "intelligent_tiering_fa",
+	"intelligenttieringiastorage":    "intelligent_tiering_ia",
+	"intelligenttieringaastorage":    "intelligent_tiering_aa",
+	"intelligenttieringaiastorage":   "intelligent_tiering_aia",
+	"intelligenttieringdaastorage":   "intelligent_tiering_daa",
+	"glacierstorage":                 "glacier",
+	"glacierstagingstorage":          "glacier_staging",
+	"glacierobjectoverhead":          "glacier_overhead",
+	"glaciers3objectoverhead":        "glacier_s3_overhead",
+	"glacierinstantretrievalstorage": "glacier_ir",
+	"deeparchivestorage":             "deep_archive",
+	"deeparchivestagingstorage":      "deep_archive_staging",
+	"deeparchiveobjectoverhead":      "deep_archive_overhead",
+	"deeparchives3objectoverhead":    "deep_archive_s3_overhead",
+}
+
+// normalizeStorageType returns the short name for a lowercased CloudWatch
+// storage type, or the storage type itself if it's not one we know of.
+func normalizeStorageType(raw string) string {
+	if name, ok := storageTypes[raw]; ok {
+		return name
+	}
+	return raw
+}
+
+var percentileRE = regexp.MustCompile(`^p\d{1,2}(\.\d+)?$`)
+
+// statLevel returns the statistic as a single level of the path, like p99_9
+// for p99.9.
+func statLevel(stat string) string {
+	return strings.Replace(stat, ".", "_", -1)
+}
+
+// prefixRE matches the prefixes that graphite can take as they are.
+var prefixRE = regexp.MustCompile(`^[A-Za-z0-9._-]*$`)
+
+// Config holds the settings that can be given in a configuration file. Each
+// one is the default for the command line flag of the same meaning.
+type Config struct {
+	Regions    []string `yaml:"regions"`     // -r
+	Prefix     string   `yaml:"prefix"`      // -p
+	Graphite   string   `yaml:"graphite"`    // -g
+	Include    []string `yaml:"include"`     // -include
+	Exclude    []string `yaml:"exclude"`     // -exclude
+	Format     string   `yaml:"format"`      // -format
+	Profile    string   `yaml:"profile"`     // -profile
+	RoleARN    string   `yaml:"role_arn"`    // -role-arn
+	ExternalID string   `yaml:"external_id"` // -external-id
+}
+
+func loadConfig(path string) (Config, error) {
+	var cfg Config
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("%s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// apply sets the flags that were not given on the command line to the
+// values in the configuration.
+func (cfg Config) apply() {
+	set := func(name, value string) {
+		if len(value) > 0 && !isFlagSet(name) {
+			flag.Set(name, value)
+		}
+	}
+	set("r", strings.Join(cfg.Regions, ","))
+	set("p", cfg.Prefix)
+	set("g", cfg.Graphite)
+	set("include", strings.Join(cfg.Include, ","))
+	set("exclude", strings.Join(cfg.Exclude, ","))
+	set("format", cfg.Format)
+	set("profile", cfg.Profile)
+	set("role-arn", cfg.RoleARN)
+	set("external-id", cfg.ExternalID)
+}
+
+var errNoMetrics = errors.New("no metrics were found")
+
+// namespace is the CloudWatch namespace to get the metrics from.
+var namespace = "AWS/S3"
+
+// location is the timezone the days are worked out in, set by -tz.
+var location = time.UTC
+
+// These are set when building, with -ldflags "-X main.version=... -X main.buildDate=..."
+var (
+	version   = "dev"
+	buildDate = "unknown"
+)
+
+func main() {
+	start := time.Now()
+	log.SetFlags(0)
+
+	// Check command line args.
+	prefix := flag.String("p", "", "`prefix` for graphite metrics names (default \"s3.<region>.\")")
+	prev := flag.Bool("1", false, "collect yesterday's metrics rather than today's")
+	date := flag.String("d", "", "collect the metrics of the given `date` (YYYY-MM-DD, in -tz) rather than today's")
+	numDays := flag.Int("days", 0, "collect the metrics of this `number` of days, up to today, or the -1 or -d day")
+	from := flag.String("from", "", "collect the metrics of each day starting from this `date`, up to -to")
+	to := flag.String("to", "", "last `date` to collect metrics for, with -from")
+	addr := flag.String("g", "127.0.0.1:2003", "`graphite server` to send metrics to, as host:port or unix:///path/to/socket, or a comma-separated list of them")
+	udp := flag.Bool("u", false, "send metrics over UDP rather than TCP")
+	regions := flag.String("r", "", "comma-separated list of `regions` to collect metrics from, appended to -p if given (default $AWS_REGION)")
+	format := flag.String("format", "graphite", "output `format`: graphite, pickle, statsd, opentsdb, json, prom or influx")
+	pickle := flag.Bool("pickle", false, "send metrics using the graphite pickle protocol (same as -format pickle)")
+	jsonOut := flag.Bool("json", false, "output metrics as newline-delimited JSON, printed to stdout unless -g is given (same as -format json)")
+	template := flag.String("template", "", "`template` for the graphite paths, like s3.{region}.{bucket}.{storage}.{metric}, using {region}, {account}, {bucket}, {storage}, {filter}, {rule}, {metric} and {stat} (default is to use -p)")
+	includeAccount := flag.Bool("include-account", false, "add the AWS account ID to the graphite paths, after the prefix, or as a tag with -tagged")
+	tagged := flag.Bool("tagged", false, "use graphite tags for the bucket, storage type and region, rather than a dotted path")
+	sep := flag.String("sep", ".", "`string` to replace dots in bucket names with in graphite paths, such as _")
+	objStorage := flag.Bool("objcount-storage", false, "include the storage type in object count metric names")
+	storageFirst := flag.Bool("storage-first", false, "put the storage type before the bucket name in the graphite paths, like s3.<region>.<storage>.<bucket>.size")
+	excludeStorage := flag.String("exclude-storage", "", "comma-separated `list` of storage types not to report the size of, like rrs,onezone_ia")
+	rawStorage := flag.Bool("raw-storage", false, "use CloudWatch's storage type names, like standardiastorage, rather than short ones like standard_ia")
+	retries := flag.Int("retries", 5, "maximum number of `retries` for failed or throttled CloudWatch requests")
+	period := flag.Duration("period", 24*time.Hour, "CloudWatch `period` for storage metrics, a multiple of 1m")
+	include := flag.String("include", "", "comma-separated glob `patterns` of bucket names to collect metrics for")
+	exclude := flag.String("exclude", "", "comma-separated glob `patterns` of bucket names to skip")
+	bucketList := flag.String("buckets", "", "comma-separated `list` of buckets to get the standard storage size and object count of, without listing all the metrics")
+	match := flag.String("match", "", "only collect metrics for buckets whose names match this `regexp`")
+	limit := flag.Int("n", 0, "only collect metrics for this `number` of buckets in each region, 0 for all")
+	sizeUnit := flag.String("size-unit", "", "report the sizes in this `unit`, one of kb, mb, gb or tb, as size_<unit> (default is bytes)")
+	age := flag.Bool("age", false, "also report how many hours old the size of each bucket is, from the end of its -period, as age_hours")
+	growth := flag.Bool("growth", false, "also report the percentage change in the size of each bucket since 30 days before, as growth_pct")
+	anomaly := flag.Float64("anomaly-threshold", 0, "also report an anomaly metric for each bucket, 1 if its size grew by more than this `percentage` since the day before, 0 otherwise or if it was empty")
+	minSize := flag.Int64("min-size", 0, "don't report the size of buckets smaller than this many `bytes`")
+	round := flag.Bool("round", false, "report the metrics with the timestamp of the start of their day, in -tz")
+	tz := flag.String("tz", "UTC", "work out the days in this `timezone`, such as America/New_York, rather than UTC")
+	maxAge := flag.Duration("max-age", 48*time.Hour, "warn about datapoints older than this `age`, 0 to never warn")
+	skipOld := flag.Bool("skip-old", false, "skip datapoints older than -max-age rather than just warning")
+	pct := flag.String("pct", "p50,p90,p99", "comma-separated `percentiles` to collect for latency metrics")
+	metricsList := flag.String("metrics", "size,objcount", "comma-separated `list` of metrics to collect, like size,objcount,getrequests, or all")
+	noSize := flag.Bool("no-size", false, "don't collect the bucket sizes")
+	noObjcount := flag.Bool("no-objcount", false, "don't collect the object counts")
+	metricData := flag.Bool("use-getmetricdata", false, "fetch the size and object count of up to 500 buckets at a time using GetMetricData")
+	rateLimit := flag.Float64("rate-limit", 0, "make at most this `number` of CloudWatch API requests per second in each region, 0 for no limit")
+	flag.StringVar(&namespace, "namespace", namespace, "CloudWatch `namespace` to get the metrics from, for custom metrics shaped like the S3 ones")
+	failFast := flag.Bool("fail-fast", false, "stop at the first error getting a metric, rather than reporting the rest")
+	concurrency := flag.Int("concurrency", 10, "`number` of CloudWatch requests to make in parallel")
+	regionConcurrency := flag.Int("region-concurrency", 1, "`number` of regions to collect the metrics of at the same time")
+	outFile := flag.String("o", "", "also write the metrics to this `file`, instead of sending them unless -g is given")
+	summaryFile := flag.String("summary", "", "also write a summary of the size and object count of each bucket, as JSON, to this `file`, with the sizes in bytes")
+	gzipOut := flag.Bool("gzip", false, "compress the -o file with gzip, adding .gz to its name")
+	appendOut := flag.Bool("append", false, "append to the -o file rather than overwriting it")
+	sortOut := flag.Bool("sort", true, "sort the metrics by path, across all regions, rather than reporting them in the order they were got")
+	verbose := flag.Bool("v", false, "print the metrics and progress messages")
+	timeout := flag.Duration("timeout", 10*time.Second, "`timeout` for connecting and sending the metrics, 0 for none")
+	batch := flag.Int("batch", 1000, "`number` of lines to send to the graphite server in each write, 0 for all at once")
+	sendRetries := flag.Int("send-retries", 3, "`number` of times to try sending to the graphite server again if it fails")
+	emptyExit := flag.Int("empty-exit", 1, "exit `code` to use when no metrics were found")
+	quietEmpty := flag.Bool("quiet-empty", false, "don't warn when no metrics were found")
+	testConn := flag.Bool("test-connection", false, "check that the graphite server can be connected to before collecting the metrics")
+	useTLS := flag.Bool("tls", false, "connect to the graphite server over TLS")
+	tlsInsecure := flag.Bool("tls-insecure", false, "don't verify the graphite server's TLS certificate")
+	measurement := flag.String("measurement", "s3_bucket", "InfluxDB `measurement` to write the metrics to")
+	extraTags := flag.String("extra-tags", "", "comma-separated `list` of name=value tags to add to each InfluxDB line")
+	influxURL := flag.String("influx-url", "", "with -format influx, the InfluxDB `url` to POST the metrics to, such as http://localhost:8086/write?db=s3")
+	dryRun := flag.Bool("dry-run", false, "print the metrics but don't send them")
+	// AWS_PROFILE is used by the SDK for credentials anyway, but this also
+	// gets the region from the profile
+	profile := flag.String("profile", os.Getenv("AWS_PROFILE"), "use the named `profile` from the AWS shared credentials file")
+	endpoint := flag.String("endpoint", "", "CloudWatch endpoint `url` to use instead of the default, such as http://localhost:4566")
+	roleARN := flag.String("role-arn", "", "`ARN` of an IAM role to assume for accessing CloudWatch")
+	externalID := flag.String("external-id", "", "external `id` to use when assuming -role-arn")
+	listen := flag.String("listen", "", "serve the metrics for Prometheus at /metrics on this `address` instead, such as :9102")
+	cacheTTL := flag.Duration("cache-ttl", 5*time.Minute, "with -listen, the minimum `time` between collections from CloudWatch")
+	interval := flag.Duration("interval", 0, "keep running, collecting and sending the metrics every `interval`")
+	configFile := flag.String("config", "", "read settings from this YAML `file`, which the other flags override")
+	stateFile := flag.String("state", "", "keep the timestamps last reported in this `file`, reporting a stale marker for buckets whose storage metrics haven't changed")
+	aggregate := flag.Bool("aggregate", false, "also report the total size and object count of all buckets, by storage type")
+	toCloudWatch := flag.Bool("to-cloudwatch", false, "also put the total size and object count of each bucket, and of all buckets with -aggregate, into CloudWatch under "+putNamespace)
+	list := flag.Bool("list", false, "list the metrics available in CloudWatch and exit")
+	logLevel := flag.String("log-level", "info", "only log messages of at least this `level`: debug, info, warn or error")
+	logTimestamps := flag.Bool("log-timestamps", false, "include timestamps in log messages")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "s3report - Collects today's S3 metrics and reports them to Graphite\n")
+		flag.PrintDefaults()
+	}
+	showVersion := flag.Bool("version", false, "print the version and exit")
+	flag.Parse()
+	if *showVersion {
+		fmt.Printf("s3report %s, built %s with %s\n", version, buildDate, runtime.Version())
+		os.Exit(0)
+	}
+	if *logTimestamps {
+		log.SetFlags(log.LstdFlags)
+	}
+	if err := setLogLevel(*logLevel); err != nil {
+		log.Fatal(err)
+	}
+	if len(*configFile) > 0 {
+		cfg, err := loadConfig(*configFile)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		cfg.apply()
+	}
+	// The prefix is joined to the rest of the path as is
+	if !prefixRE.MatchString(*prefix) {
+		log.Fatalf("bad prefix %q, it can only have letters, digits, '.', '-' and '_'", *prefix)
+	}
+	if len(*prefix) > 0 && !strings.HasSuffix(*prefix, ".") {
+		*prefix += "."
+	}
+	if loc, err := time.LoadLocation(*tz); err != nil {
+		log.Fatalf("bad -tz %q: %v", *tz, err)
+	} else {
+		location = loc
+	}
+	// Check the dates now, they are worked out again for each run
+	_, err := collectionDays(*prev, *date, *from, *to, *numDays)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if *period < time.Minute || *period%time.Minute != 0 || *period > 24*time.Hour {
+		log.Fatal("-period must be a multiple of 1m, up to 24h")
+	}
+	includeList, excludeList := splitList(*include), splitList(*exclude)
+	for _, p := range append(includeList, excludeList...) {
+		if _, err := path.Match(p, ""); err != nil {
+			log.Fatalf("bad bucket name pattern %q", p)
+		}
+	}
+	var matchRE *regexp.Regexp
+	if len(*match) > 0 {
+		if matchRE, err = regexp.Compile(*match); err != nil {
+			log.Fatalf("bad -match regexp: %v", err)
+		}
+	}
+	pctList := splitList(*pct)
+	for _, p := range pctList {
+		if !percentileRE.MatchString(p) {
+			log.Fatalf("bad percentile %q, expected something like p99 or p99.9", p)
+		}
+	}
+	if *concurrency < 1 {
+		log.Fatal("-concurrency must be at least 1")
+	}
+	if *regionConcurrency < 1 {
+		log.Fatal("-region-concurrency must be at least 1")
+	}
+	if *jsonOut {
+		*format = "json"
+	} else if *pickle {
+		*format = "pickle"
+	}
+	if *tagged && len(*template) > 0 {
+		log.Fatal("-tagged and -template cannot be used together")
+	}
+	if *tagged && *storageFirst {
+		log.Fatal("-tagged and -storage-first cannot be used together")
+	}
+	if *tagged && *format != "graphite" && *format != "pickle" {
+		log.Fatal("-tagged can only be used with the graphite and pickle formats")
+	}
+	if len(*influxURL) > 0 && *format != "influx" {
+		log.Fatal("-influx-url can only be used with -format influx")
+	}
+	if (isFlagSet("measurement") || len(*extraTags) > 0) && *format != "influx" {
+		log.Fatal("-measurement and -extra-tags can only be used with -format influx")
+	}
+	if len(*measurement) == 0 {
+		log.Fatal("-measurement cannot be empty")
+	}
+	var influxTags string
+	for _, tag := range splitList(*extraTags) {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 || len(kv[0]) == 0 || len(kv[1]) == 0 {
+			log.Fatalf("bad tag %q in -extra-tags, expected name=value", tag)
+		}
+		influxTags += "," + influxEscaper.Replace(kv[0]) + "=" + influxEscaper.Replace(kv[1])
+	}
+	if *gzipOut && len(*outFile) == 0 {
+		log.Fatal("-gzip can only be used with -o")
+	}
+	switch *format {
+	case "graphite", "json", "prom", "influx":
+	case "pickle":
+		if *udp {
+			log.Fatal("the pickle protocol cannot be sent over UDP")
+		}
+		if !isFlagSet("g") {
+			*addr = "127.0.0.1:2004"
+		}
+	case "opentsdb":
+		if *udp {
+			log.Fatal("OpenTSDB metrics cannot be sent over UDP")
+		}
+		if !isFlagSet("g") {
+			*addr = "127.0.0.1:4242"
+		}
+	case "statsd":
+		// StatsD listens on UDP, on a port of its own
+		*udp = true
+		if !isFlagSet("g") {
+			*addr = "127.0.0.1:8125"
+		}
+	default:
+		log.Fatalf("unknown format %q", *format)
+	}
+	var tlsConfig *tls.Config
+	if *useTLS || *tlsInsecure {
+		if *udp {
+			log.Fatal("TLS cannot be used over UDP")
+		}
+		tlsConfig = &tls.Config{InsecureSkipVerify: *tlsInsecure}
+	}
+	var senders []*sender
+	for _, a := range splitList(*addr) {
+		snd := &sender{
+			addr:      a,
+			udp:       *udp,
+			timeout:   *timeout,
+			tlsConfig: tlsConfig,
+			batch:     *batch,
+			retries:   *sendRetries,
+		}
+		if *format == "pickle" {
+			// The pickle messages are binary, and batched already
+			snd.batch = 0
+		}
+		senders = append(senders, snd)
+	}
+	// JSON and file output are only sent somewhere if explicitly asked to
+	send := len(senders) > 0 && (isFlagSet("g") || (*format != "json" && len(*outFile) == 0))
+	if *format == "prom" || *format == "influx" {
+		// Prometheus can only read the metrics from a file, and InfluxDB
+		// is written to over HTTP
+		send = false
+	}
+	if *testConn && send && !*dryRun {
+		for _, snd := range senders {
+			conn, err := snd.dial()
+			if err != nil {
+				log.Fatalf("cannot connect to the graphite server: %v", err)
+			}
+			conn.Close()
+		}
+	}
+
+	// Create CloudWatch service. Credentials are left to the SDK, which looks
+	// in the environment, the shared credentials file and the EC2 instance
+	// role.
+	sess, err := newSession(*profile)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	// Assume the role, if asked to, using the session's credentials
+	var creds *credentials.Credentials
+	if len(*roleARN) > 0 {
+		creds = stscreds.NewCredentials(sess, *roleARN, func(p *stscreds.AssumeRoleProvider) {
+			if len(*externalID) > 0 {
+				p.ExternalID = externalID
+			}
+		})
+	}
+	var regionList []string
+	if len(*regions) > 0 {
+		regionList = splitList(*regions)
+	} else if region := aws.StringValue(sess.Config.Region); len(region) > 0 {
+		regionList = []string{region}
+	} else if region, err := ec2metadata.New(sess).Region(); err == nil {
+		// Running on EC2, use the instance's own region
+		regionList = []string{region}
+	} else if len(*profile) > 0 {
+		log.Fatalf("No region set for profile %s, please set the environment variable AWS_REGION", *profile)
+	} else {
+		log.Fatal("Please set the environment variable AWS_REGION or use -r")
+	}
+
+	// Look up the account ID once, if it's needed
+	var account string
+	if *includeAccount || strings.Contains(*template, "{account}") {
+		if account, err = accountID(sess, creds); err != nil {
+			log.Fatalf("failed to get the AWS account ID: %v", err)
+		}
+	}
+
+	// Load the timestamps last reported, if we're keeping track of them
+	var seen lastSeen
+	if len(*stateFile) > 0 {
+		if seen, err = loadLastSeen(*stateFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	skipStorage := make(map[string]bool)
+	for _, stype := range splitList(strings.ToLower(*excludeStorage)) {
+		skipStorage[stype] = true
+	}
+
+	// Sizes are in bytes unless asked otherwise
+	if len(*sizeUnit) > 0 {
+		if _, ok := sizeUnits[*sizeUnit]; !ok {
+			log.Fatalf("unknown -size-unit %q, must be kb, mb, gb or tb", *sizeUnit)
+		}
+	}
+
+	// Check the metrics asked for, nil is all of them
+	var metricSet map[string]bool
+	if *metricsList != "all" {
+		supported := make(map[string]bool)
+		for _, name := range supportedMetrics() {
+			supported[name] = true
+		}
+		metricSet = make(map[string]bool)
+		for _, name := range splitList(strings.ToLower(*metricsList)) {
+			if !supported[name] {
+				log.Fatalf("unknown metric %q, must be one of: %s", name, strings.Join(supportedMetrics(), ", "))
+			}
+			metricSet[name] = true
+		}
+	}
+	if *noSize || *noObjcount {
+		if metricSet == nil {
+			metricSet = make(map[string]bool)
+			for _, name := range supportedMetrics() {
+				metricSet[name] = true
+			}
+		}
+		if *noSize {
+			delete(metricSet, "size")
+		}
+		if *noObjcount {
+			delete(metricSet, "objcount")
+		}
+	}
+
+	// Show the progress on a terminal, unless several regions are collected
+	// at once, since their lines would overwrite each other
+	showProgress := isTerminal(os.Stdout) && len(*listen) == 0 && (*regionConcurrency == 1 || len(regionList) == 1)
+
+	// Set up a collector for each region
+	var collectors []*collector
+	for _, region := range regionList {
+		// The SDK's default retryer backs off exponentially on throttling
+		cfg := &aws.Config{
+			Region:      aws.String(region),
+			MaxRetries:  aws.Int(*retries),
+			Credentials: creds,
+		}
+		if len(*endpoint) > 0 {
+			// The scheme of the URL decides whether SSL is used
+			cfg.Endpoint = endpoint
+		}
+		svc := cloudwatch.New(sess, cfg)
+		p := *prefix
+		if !isFlagSet("p") {
+			p = "s3."
+		}
+		if *includeAccount {
+			p += account + "."
+		}
+		if !isFlagSet("p") || len(*regions) > 0 {
+			p += region + "."
+		}
+		c := &collector{
+			svc:          svc,
+			region:       region,
+			prefix:       p,
+			period:       *period,
+			include:      includeList,
+			exclude:      excludeList,
+			match:        matchRE,
+			limit:        *limit,
+			maxAge:       *maxAge,
+			skipOld:      *skipOld,
+			percentiles:  pctList,
+			objStorage:   *objStorage,
+			rawStorage:   *rawStorage,
+			sep:          *sep,
+			aggregate:    *aggregate,
+			seen:         seen,
+			metricData:   *metricData,
+			metrics:      metricSet,
+			round:        *round,
+			template:     *template,
+			minSize:      *minSize,
+			storageFirst: *storageFirst,
+			account:      account,
+			only:         splitList(*bucketList),
+			sizeUnit:     *sizeUnit,
+			growth:       *growth,
+			skipStorage:  skipStorage,
+			anomaly:      *anomaly,
+			progress:     showProgress,
+			failFast:     *failFast,
+			age:          *age,
+			sorted:       *sortOut,
+		}
+		// Count the requests made, since CloudWatch charges for them
+		svc.Handlers.Send.PushBack(func(r *request.Request) { atomic.AddInt64(&c.calls, 1) })
+		if *rateLimit > 0 {
+			// Wait for our turn before each request, retries included. Signing
+			// is done for each attempt, and an error then stops it being sent.
+			limiter := rate.NewLimiter(rate.Limit(*rateLimit), 1)
+			svc.Handlers.Sign.PushFront(func(r *request.Request) {
+				if err := limiter.Wait(r.Context()); err != nil {
+					r.Error = err
+				}
+			})
+		}
+		collectors = append(collectors, c)
+	}
+
+	// Cancel the AWS calls in flight when stopped, and report what was
+	// collected until then. Stop catching the signals then, so that a second
+	// one kills us if that takes too long.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		signal.Stop(sigs)
+		infof("received %v, stopping", sig)
+		cancel()
+	}()
+
+	// Just list the available metrics, if asked to
+	if *list {
+		if err := listAll(ctx, collectors); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Serve the metrics to Prometheus, if asked to
+	if len(*listen) > 0 {
+		h := &metricsHandler{
+			ttl: *cacheTTL,
+			collect: func(ctx context.Context) ([]metric, error) {
+				// Work out the days again, today may have changed
+				days, _ := collectionDays(*prev, *date, *from, *to, *numDays)
+				metrics, _, _, err := collectAll(ctx, collectors, days, *concurrency, *regionConcurrency)
+				for i := range metrics {
+					metrics[i] = inUnit(metrics[i], *sizeUnit)
+				}
+				if err == nil {
+					// Don't serve the metrics of a cancelled request later
+					err = ctx.Err()
+				}
+				return metrics, err
+			},
+		}
+		http.Handle("/metrics", h)
+		// Stop serving when stopped. The collections of the scrapes in
+		// progress are cancelled too, so they only get a moment to finish.
+		srv := &http.Server{
+			Addr:        *listen,
+			BaseContext: func(net.Listener) context.Context { return ctx },
+		}
+		done := make(chan struct{})
+		go func() {
+			<-ctx.Done()
+			sctx, scancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer scancel()
+			srv.Shutdown(sctx)
+			close(done)
+		}()
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+		<-done
+		return
+	}
+
+	// Collect, format and output the metrics
+	run := func(start time.Time) error {
+		days, _ := collectionDays(*prev, *date, *from, *to, *numDays)
+		all, buckets, skipped, err := collectAll(ctx, collectors, days, *concurrency, *regionConcurrency)
+		if err != nil {
+			return err
+		}
+		summary := fmt.Sprintf("processed %d buckets, %d metrics, skipped %d", buckets, len(all), skipped)
+		elapsed := time.Since(start).Seconds()
+		for _, c := range collectors {
+			all = append(all, c.meta("run_duration_seconds", elapsed))
+		}
+
+		// Tag or rename a copy, the paths and names are still needed to keep
+		// track of the state
+		metrics := all
+		if *tagged || len(*sizeUnit) > 0 {
+			tagPrefix := "s3."
+			if isFlagSet("p") {
+				tagPrefix = *prefix
+			}
+			// The account is a tag too, rather than part of the prefix
+			tagAccount := ""
+			if *includeAccount {
+				tagAccount = account
+			}
+			metrics = make([]metric, len(all))
+			for i, m := range all {
+				m = inUnit(m, *sizeUnit)
+				if *tagged {
+					m.path = taggedPath(tagPrefix, tagAccount, m)
+				}
+				metrics[i] = m
+			}
+		}
+
+		if *sortOut {
+			sort.SliceStable(metrics, func(i, j int) bool {
+				if metrics[i].path != metrics[j].path {
+					return metrics[i].path < metrics[j].path
+				}
+				return metrics[i].Timestamp < metrics[j].Timestamp
+			})
+		}
+
+		buf := &bytes.Buffer{}
+		switch *format {
+		case "json":
+			writeJSON(buf, metrics)
+		case "statsd":
+			writeStatsD(buf, metrics)
+		case "pickle":
+			writePickle(buf, metrics)
+		case "prom":
+			writePrometheus(buf, metrics)
+		case "influx":
+			writeInflux(buf, metrics, *measurement, influxTags)
+		case "opentsdb":
+			writeOpenTSDB(buf, metrics)
+		default:
+			writeGraphite(buf, metrics)
+		}
+
+		found := false
+		for _, m := range all {
+			if !isMetaMetric(m) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			if !*quietEmpty {
+				warnf("No metrics were found for today.")
+				warnf("Try running it later in the day or run with \"-1\" flag.")
+			}
+			infof("%s", summary)
+			return errNoMetrics
+		}
+
+		// Print the metrics if asked to, or if there's nowhere else for them to go
+		if *verbose || *dryRun || (!send && len(*outFile) == 0 && len(*influxURL) == 0 && !*toCloudWatch) {
+			fmt.Print(buf.String())
+		}
+		if !*dryRun && len(*outFile) > 0 {
+			path, data := *outFile, buf.Bytes()
+			if *gzipOut {
+				// Appending works too, gzip files can be concatenated
+				var zbuf bytes.Buffer
+				zw := gzip.NewWriter(&zbuf)
+				zw.Write(data)
+				if err := zw.Close(); err != nil {
+					return err
+				}
+				path, data = path+".gz", zbuf.Bytes()
+			}
+			if err := writeFile(path, *appendOut, data); err != nil {
+				return err
+			}
+		}
+		if !*dryRun && len(*summaryFile) > 0 {
+			data, err := json.MarshalIndent(summarize(all), "", "  ")
+			if err != nil {
+				return err
+			}
+			if err := writeFile(*summaryFile, false, append(data, '\n')); err != nil {
+				return err
+			}
+		}
+		if !*dryRun && len(*influxURL) > 0 {
+			if *verbose {
+				fmt.Printf("writing to influxdb at %v:\n", *influxURL)
+			}
+			if err := postMetrics(*influxURL, *timeout, buf.Bytes()); err != nil {
+				return err
+			}
+			summary += fmt.Sprintf(", wrote %s to %s", formatSize(buf.Len()), *influxURL)
+		}
+		if !*dryRun && *toCloudWatch {
+			n := 0
+			for _, c := range collectors {
+				count, err := c.putTotals(all)
+				if err != nil {
+					infof("%s", summary)
+					return fmt.Errorf("failed to put metrics into cloudwatch in %s: %v", c.region, err)
+				}
+				n += count
+			}
+			summary += fmt.Sprintf(", put %d metrics into cloudwatch", n)
+		}
+		if !*dryRun && send {
+			// Keep going if a server is down, so that the others still
+			// get the metrics
+			failed := 0
+			for _, snd := range senders {
+				if *verbose {
+					fmt.Printf("sending to graphite server at %v:\n", snd.addr)
+				}
+				if err := snd.send(ctx, buf.Bytes()); err != nil {
+					errorf("failed to send to %s: %v", snd.addr, err)
+					failed++
+					continue
+				}
+				if *verbose {
+					fmt.Println("done.")
+				}
+				summary += fmt.Sprintf(", sent %s to %s", formatSize(buf.Len()), snd.addr)
+			}
+			if failed > 0 {
+				infof("%s", summary)
+				return fmt.Errorf("failed to send to %d of %d graphite servers", failed, len(senders))
+			}
+		}
+		infof("%s", summary)
+
+		// Remember what was reported, now that it's been done
+		if !*dryRun && seen != nil {
+			seen.update(all)
+			if err := seen.save(*stateFile); err != nil {
+				return err
+			}
+		}
+		if ctx.Err() != nil {
+			return errors.New("interrupted, only the metrics collected until then were reported")
+		}
+		var failed int64
+		for _, c := range collectors {
+			failed += c.failed
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d metrics could not be got, the rest were reported", failed)
+		}
+		return nil
+	}
+
+	// Run every interval until stopped, if asked to
+	if *interval > 0 {
+		ticker := time.NewTicker(*interval)
+		defer ticker.Stop()
+		// Only one run at a time, so that a slow one doesn't get its
+		// metrics sent again by the next
+		busy := make(chan struct{}, 1)
+		for {
+			select {
+			case busy <- struct{}{}:
+				go func(start time.Time) {
+					defer func() { <-busy }()
+					if err := run(start); err != nil && err != errNoMetrics {
+						errorf("%v", err)
+					}
+				}(start)
+			default:
+				warnf("previous run has not finished yet, skipping this one")
+			}
+			select {
+			case <-ticker.C:
+				start = time.Now()
+			case <-ctx.Done():
+				// Let the current run finish first
+				busy <- struct{}{}
+				return
+			}
+		}
+	}
+
+	switch err := run(start); err {
+	case nil:
+	case errNoMetrics:
+		os.Exit(*emptyExit)
+	default:
+		log.Fatal(err)
+	}
+}
+
+// collector collects the metrics of a single region.
+type collector struct {
+	svc          *cloudwatch.CloudWatch
+	region       string
+	prefix       string
+	period       time.Duration
+	include      []string
+	exclude      []string
+	match        *regexp.Regexp
+	limit        int
+	maxAge       time.Duration
+	skipOld      bool
+	percentiles  []string
+	objStorage   bool
+	rawStorage   bool
+	sep          string
+	aggregate    bool
+	seen         lastSeen
+	metrics      map[string]bool // the metrics to collect, nil for all
+	round        bool            // report timestamps as the start of the day
+	template     string          // graphite path template, instead of the prefix
+	minSize      int64           // smallest size to report, in bytes
+	storageFirst bool            // put the storage type before the bucket name
+	account      string          // AWS account ID, for the template
+	only         []string        // buckets to query without listing the metrics
+	sizeUnit     string          // unit to report the sizes in, empty for bytes
+	growth       bool            // also report the change in size over 30 days
+	skipStorage  map[string]bool // storage types not to report the size of
+	anomaly      float64         // percentage growth in a day to report as an anomaly
+	progress     bool            // show the progress on stderr
+	failFast     bool            // stop at the first error
+	age          bool            // also report the age of the sizes
+	sorted       bool            // sort the output by path
+
+	buckets int   // number of buckets queried
+	skipped int64 // number of metrics that failed or had no data
+	calls   int64 // number of CloudWatch API requests made
+	failed  int64 // number of metrics that could not be got
+	cancel  context.CancelFunc
+
+	metricData bool                    // use GetMetricData for the storage metrics
+	fetched    map[string]storagePoint // the storage metrics, by fetchKey
+}
+
+// listAll prints a table of the metrics available in each region.
+func listAll(ctx context.Context, collectors []*collector) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "REGION\tMETRIC\tDIMENSIONS")
+	for _, c := range collectors {
+		metrics, err := listMetrics(ctx, c.svc)
+		if err != nil {
+			return fmt.Errorf("%s: %v", c.region, err)
+		}
+		for _, m := range metrics {
+			var dims []string
+			for _, d := range m.Dimensions {
+				dims = append(dims, *d.Name+"="+*d.Value)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", c.region, *m.MetricName, strings.Join(dims, ", "))
+		}
+	}
+	return w.Flush()
+}
+
+// collectAll collects the metrics of all regions for the given days, up to
+// regionConcurrency regions at a time. It also returns the total number of
+// buckets queried and metrics skipped.
+func collectAll(ctx context.Context, collectors []*collector, days []time.Time, concurrency, regionConcurrency int) ([]metric, int, int, error) {
+	results := make([][]metric, len(collectors))
+	errs := make([]error, len(collectors))
+	sem := make(chan struct{}, regionConcurrency)
+	var wg sync.WaitGroup
+	for i, c := range collectors {
+		if ctx.Err() != nil {
+			break
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, c *collector) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			results[i], errs[i] = c.collect(ctx, days, concurrency)
+		}(i, c)
+	}
+	wg.Wait()
+
+	// Keep the regions in the order they were given
+	var all []metric
+	var buckets, skipped int
+	for i, c := range collectors {
+		if errs[i] != nil {
+			return nil, 0, 0, fmt.Errorf("%s: %v", c.region, errs[i])
+		}
+		all = append(all, results[i]...)
+		buckets += c.buckets
+		skipped += int(c.skipped)
+	}
+	return all, buckets, skipped, nil
+}
+
+func (c *collector) collect(ctx context.Context, days []time.Time, concurrency int) ([]metric, error) {
+	c.buckets, c.skipped, c.calls, c.failed = 0, 0, 0, 0
+	ctx, c.cancel = context.WithCancel(ctx)
+	defer c.cancel()
+
+	// List all metrics in the namespace, unless we were told which
+	// buckets to look at
+	var metrics []*cloudwatch.Metric
+	if len(c.only) > 0 {
+		metrics = bucketMetrics(c.only)
+	} else {
+		var err error
+		if metrics, err = listMetrics(ctx, c.svc); err != nil {
+			return nil, err
+		}
+	}
+
+	// Drop the buckets we're not interested in, or that are over the limit,
+	// and any metrics listed more than once, before fetching anything
+	var wanted []*cloudwatch.Metric
+	names := make(map[string]bool)
+	listed := make(map[string]bool)
+	for _, m := range metrics {
+		name := dimension(m, "BucketName")
+		if len(name) == 0 {
+			// Account-level metrics, which we don't report
+			debugf("skipping %s, it has no bucket name", metricKey(m))
+			continue
+		}
+		if !c.wanted(name) {
+			continue
+		}
+		if c.metrics != nil && !c.metrics[metricName(*m.MetricName)] {
+			continue
+		}
+		key := metricKey(m)
+		if listed[key] {
+			continue
+		}
+		listed[key] = true
+		if !names[name] {
+			if c.limit > 0 && len(names) == c.limit {
+				continue
+			}
+			names[name] = true
+		}
+		wanted = append(wanted, m)
+	}
+	metrics = wanted
+	c.buckets = len(names)
+
+	// Fetch all the storage metrics in as few calls as possible, if asked to
+	c.fetched = nil
+	if c.metricData {
+		var storage []*cloudwatch.Metric
+		for _, m := range metrics {
+			if *m.MetricName == "BucketSizeBytes" || *m.MetricName == "NumberOfObjects" {
+				storage = append(storage, m)
+			}
+		}
+		c.fetched = make(map[string]storagePoint)
+		fetched := make(map[string]bool)
+		for _, day := range days {
+			fetch := []time.Time{day}
+			if c.anomaly > 0 {
+				// The size on the day before is needed too
+				fetch = append(fetch, day.AddDate(0, 0, -1))
+			}
+			for _, d := range fetch {
+				if k := d.Format("2006-01-02"); !fetched[k] {
+					fetched[k] = true
+					c.fetchStorage(ctx, storage, d)
+				}
+			}
+		}
+	}
+
+	// Fetch each metric for each day using a pool of workers
+	type job struct {
+		m   *cloudwatch.Metric
+		day time.Time
+	}
+	jobs := make(chan job)
+	results := make(chan metric)
+	var done int64
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				for _, r := range c.collectMetric(ctx, j.m, j.day) {
+					if !c.checkAge(r, j.day) {
+						continue
+					}
+					if c.round {
+						r.Timestamp = startOfDay(r.Timestamp)
+					}
+					results <- r
+				}
+				atomic.AddInt64(&done, 1)
+			}
+		}()
+	}
+
+	// Show how far along we are, for interactive runs
+	stop := make(chan struct{})
+	var shown sync.WaitGroup
+	if c.progress {
+		total := len(metrics) * len(days)
+		shown.Add(1)
+		go func() {
+			defer shown.Done()
+			ticker := time.NewTicker(time.Second)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					fmt.Fprintf(os.Stderr, "\r%s: processed %d/%d metrics...", c.region, atomic.LoadInt64(&done), total)
+				case <-stop:
+					fmt.Fprintf(os.Stderr, "\r%s: processed %d/%d metrics   \n", c.region, atomic.LoadInt64(&done), total)
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		// Stop handing out work once cancelled
+	loop:
+		for _, day := range days {
+			for _, m := range metrics {
+				select {
+				case jobs <- job{m, day}:
+				case <-ctx.Done():
+					break loop
+				}
+			}
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	var out []metric
+	for r := range results {
+		out = append(out, r)
+	}
+	close(stop)
+	shown.Wait()
+	if c.failFast && c.failed > 0 {
+		return nil, errors.New("stopped after the first error")
+	}
+	// If cancelled, carry on with what we have so that it still gets reported
+	out = append(out, c.bucketTotals(out)...)
+	for i := range out {
+		out[i] = c.templated(out[i])
+	}
+	// Workers finish in any order, so sort to keep the output stable
+	if c.sorted {
+		sort.Slice(out, func(i, j int) bool {
+			if out[i].path != out[j].path {
+				return out[i].path < out[j].path
+			}
+			return out[i].Timestamp < out[j].Timestamp
+		})
+	}
+
+	if c.aggregate {
+		out = append(out, c.totals(out)...)
+	}
+	if c.seen != nil {
+		out = c.markStale(out)
+	}
+	out = append(out, c.meta("bucketcount", float64(c.buckets)))
+	out = append(out, c.meta("cloudwatch_api_calls", float64(atomic.LoadInt64(&c.calls))))
+	return out, nil
+}
+
+// meta returns a metric about the collection itself, rather than a bucket.
+func (c *collector) meta(name string, value float64) metric {
+	return c.templated(metric{
+		Region: c.region, Bucket: "_meta", Name: name, Value: value, Timestamp: time.Now().Unix(),
+		path: c.prefix + "_meta." + name,
+	})
+}
+
+// templated sets the path of the metric from the -template, if there is one.
+// Levels of the template that come out empty for the metric, like the
+// storage type of a request metric, are left out.
+func (c *collector) templated(m metric) metric {
+	if len(c.template) == 0 {
+		return m
+	}
+	r := strings.NewReplacer(
+		"{region}", c.sanitize(m.Region),
+		"{account}", c.sanitize(c.account),
+		"{bucket}", c.sanitize(m.Bucket),
+		"{storage}", c.sanitize(m.Storage),
+		"{filter}", c.sanitize(m.Filter),
+		"{rule}", c.sanitize(m.Rule),
+		"{metric}", c.nameOf(m.Name),
+		"{stat}", statLevel(m.Stat),
+	)
+	var levels []string
+	for _, level := range strings.Split(r.Replace(c.template), ".") {
+		if len(level) > 0 {
+			levels = append(levels, level)
+		}
+	}
+	m.path = strings.Join(levels, ".")
+	return m
+}
+
+// bucketTotals sums the size of each bucket over all its storage types, for
+// each day.
+func (c *collector) bucketTotals(metrics []metric) []metric {
+	type key struct {
+		bucket string
+		day    int64
+	}
+	sums := make(map[key]*metric)
+	var keys []key
+	for _, m := range metrics {
+		if m.Name != "size" {
+			continue
+		}
+		k := key{m.Bucket, startOfDay(m.Timestamp)}
+		t, ok := sums[k]
+		if !ok {
+			t = &metric{
+				Region: c.region, Bucket: m.Bucket, Storage: "total", Name: "size",
+				path: c.storagePath(c.sanitize(m.Bucket), "total", c.nameOf("size")),
+			}
+			sums[k] = t
+			keys = append(keys, k)
+		}
+		t.Value += m.Value
+		if m.Timestamp > t.Timestamp {
+			t.Timestamp = m.Timestamp
+		}
+	}
+
+	var out []metric
+	for _, k := range keys {
+		out = append(out, *sums[k])
+	}
+	return out
+}
+
+// putNamespace is the CloudWatch namespace that -to-cloudwatch puts the
+// totals into.
+const putNamespace = "Custom/S3Report"
+
+// maxPutMetrics is the most metrics a PutMetricData call can have.
+const maxPutMetrics = 1000
+
+// putTotals puts the total size and object count of each bucket of the
+// region, and of all of them if aggregated, into CloudWatch. The sizes are
+// put in bytes whatever the -size-unit, so that alarms don't depend on it.
+// It returns how many were put.
+func (c *collector) putTotals(metrics []metric) (int, error) {
+	var data []*cloudwatch.MetricDatum
+	for _, m := range metrics {
+		if m.Region != c.region || !isStorageMetric(m) || (m.Name == "size" && m.Storage != "total") {
+			continue
+		}
+		d := &cloudwatch.MetricDatum{
+			MetricName: aws.String("BucketSizeBytes"),
+			Unit:       aws.String(cloudwatch.StandardUnitBytes),
+			Value:      aws.Float64(m.Value),
+			Timestamp:  aws.Time(time.Unix(m.Timestamp, 0)),
+		}
+		if m.Name == "objcount" {
+			d.MetricName = aws.String("NumberOfObjects")
+			d.Unit = aws.String(cloudwatch.StandardUnitCount)
+		}
+		// The totals of all buckets have no bucket dimension
+		if m.Bucket != "_total" {
+			d.Dimensions = []*cloudwatch.Dimension{
+				{Name: aws.String("BucketName"), Value: aws.String(m.Bucket)},
+			}
+		}
+		data = append(data, d)
+	}
+
+	// Not cancellable, so that what was collected until stopped still goes
+	for i := 0; i < len(data); i += maxPutMetrics {
+		j := i + maxPutMetrics
+		if j > len(data) {
+			j = len(data)
+		}
+		_, err := c.svc.PutMetricData(&cloudwatch.PutMetricDataInput{
+			Namespace:  aws.String(putNamespace),
+			MetricData: data[i:j],
+		})
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(data), nil
+}
+
+// totals sums the storage metrics of all buckets by storage type, for each
+// day.
+func (c *collector) totals(metrics []metric) []metric {
+	type key struct {
+		name, storage string
+		day           int64
+	}
+	sums := make(map[key]*metric)
+	var keys []key
+	for _, m := range metrics {
+		if !isStorageMetric(m) {
+			continue
+		}
+		k := key{m.Name, m.Storage, startOfDay(m.Timestamp)}
+		t, ok := sums[k]
+		if !ok {
+			t = &metric{
+				Region: c.region, Bucket: "_total", Storage: m.Storage, Name: m.Name,
+				path: c.storagePath("_total", c.sanitize(m.Storage), c.nameOf(m.Name)),
+			}
+			sums[k] = t
+			keys = append(keys, k)
+		}
+		t.Value += m.Value
+		if m.Timestamp > t.Timestamp {
+			t.Timestamp = m.Timestamp
+		}
+	}
+
+	var out []metric
+	for _, k := range keys {
+		out = append(out, c.templated(*sums[k]))
+	}
+	return out
+}
+
+// markStale drops the storage metrics whose timestamps are no newer than
+// the last ones reported, adding a stale marker for their buckets instead.
+func (c *collector) markStale(metrics []metric) []metric {
+	var out []metric
+	stale := make(map[string]bool)
+	for _, m := range metrics {
+		if last, ok := c.seen[m.path]; ok && isStorageMetric(m) && m.Timestamp <= last {
+			stale[m.Bucket] = true
+			continue
+		}
+		out = append(out, m)
+	}
+	if len(stale) == 0 {
+		return out
+	}
+
+	now := time.Now().Unix()
+	for bucket := range stale {
+		out = append(out, c.templated(metric{
+			Region: c.region, Bucket: bucket, Name: "stale", Value: 1, Timestamp: now,
+			path: fmt.Sprintf("%s%s.stale", c.prefix, c.sanitize(bucket)),
+		}))
+	}
+	if c.sorted {
+		sort.Slice(out, func(i, j int) bool { return out[i].path < out[j].path })
+	}
+	return out
+}
+
+func isMetaMetric(m metric) bool {
+	return m.Bucket == "_meta"
+}
+
+// inUnit returns the metric with the size in the -size-unit, if any, and
+// named size_<unit>. The sizes are worked with in bytes until output.
+func inUnit(m metric, unit string) metric {
+	if m.Name == "size" && len(unit) > 0 {
+		m.Value /= sizeUnits[unit]
+		m.Name += "_" + unit
+	}
+	return m
+}
+
+func isStorageMetric(m metric) bool {
+	return m.Name == "size" || m.Name == "objcount"
+}
+
+// lastSeen records the timestamp last reported for each storage metric,
+// keyed by graphite path.
+type lastSeen map[string]int64
+
+func loadLastSeen(path string) (lastSeen, error) {
+	seen := make(lastSeen)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return seen, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &seen); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return seen, nil
+}
+
+func (seen lastSeen) update(metrics []metric) {
+	for _, m := range metrics {
+		if isStorageMetric(m) && m.Timestamp > seen[m.path] {
+			seen[m.path] = m.Timestamp
+		}
+	}
+}
+
+func (seen lastSeen) save(path string) error {
+	data, err := json.MarshalIndent(seen, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(path, false, data)
+}
+
+// checkAge warns if the metric is older than maxAge, as of the end of the
+// day it was collected for, and returns false if it should be skipped.
+func (c *collector) checkAge(m metric, day time.Time) bool {
+	if c.maxAge <= 0 {
+		return true
+	}
+	y, mon, d := day.Date()
+	ref := time.Date(y, mon, d, 0, 0, 0, 0, location).AddDate(0, 0, 1)
+	if now := time.Now(); now.Before(ref) {
+		ref = now
+	}
+	age := ref.Sub(time.Unix(m.Timestamp, 0))
+	if age <= c.maxAge {
+		return true
+	}
+	warnf("%s is %v old, metrics may not be published for bucket %s", m.path, age.Truncate(time.Minute), m.Bucket)
+	if c.skipOld {
+		atomic.AddInt64(&c.skipped, 1)
+		return false
+	}
+	return true
+}
+
+// fail logs and counts a metric that could not be got, stopping the
+// collection for -fail-fast. Once stopped, the calls in flight all fail
+// because of it, so those are left out.
+func (c *collector) fail(ctx context.Context, format string, args ...interface{}) []metric {
+	if ctx.Err() != nil {
+		return nil
+	}
+	errorf(format, args...)
+	atomic.AddInt64(&c.failed, 1)
+	if c.failFast {
+		c.cancel()
+	}
+	return c.skip()
+}
+
+func (c *collector) skip() []metric {
+	atomic.AddInt64(&c.skipped, 1)
+	return nil
+}
+
+// sanitize returns name for use as one level of a graphite path. Dots are
+// replaced with the -sep string, since they would otherwise split the name
+// across levels of the graphite tree. Any other character that is not a
+// letter, digit, '-' or '_' is replaced with '_'.
+func (c *collector) sanitize(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '.' || r == '-' || r == '_' ||
+			(r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+	return strings.Replace(name, ".", c.sep, -1)
+}
+
+// nameOf returns the name of the metric to use in the path, which for the size
+// includes the -size-unit.
+func (c *collector) nameOf(name string) string {
+	if name == "size" && len(c.sizeUnit) > 0 {
+		return name + "_" + c.sizeUnit
+	}
+	return name
+}
+
+// storagePath returns the path of a storage metric, with the storage type
+// after the bucket name, or before it for -storage-first.
+func (c *collector) storagePath(bucket, stype, name string) string {
+	if c.storageFirst {
+		return c.prefix + stype + "." + bucket + "." + name
+	}
+	return c.prefix + bucket + "." + stype + "." + name
+}
+
+func (c *collector) wanted(bucket string) bool {
+	if len(c.include) > 0 && !matchAny(c.include, bucket) {
+		return false
+	}
+	if c.match != nil && !c.match.MatchString(bucket) {
+		return false
+	}
+	return !matchAny(c.exclude, bucket)
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// metricKey returns a string that identifies the metric by its name and
+// dimensions.
+func metricKey(m *cloudwatch.Metric) string {
+	dims := make([]string, 0, len(m.Dimensions))
+	for _, d := range m.Dimensions {
+		dims = append(dims, *d.Name+"="+*d.Value)
+	}
+	sort.Strings(dims)
+	return *m.MetricName + "," + strings.Join(dims, ",")
+}
+
+func dimension(m *cloudwatch.Metric, name string) string {
+	for _, d := range m.Dimensions {
+		if *d.Name == name {
+			return *d.Value
+		}
+	}
+	return ""
+}
+
+// getStorage gets the size or object count of a bucket, from those fetched
+// already if GetMetricData is used.
+func (c *collector) getStorage(ctx context.Context, m *cloudwatch.Metric, day time.Time) (time.Time, float64, error) {
+	if c.fetched != nil {
+		p := c.fetched[fetchKey(m, day)]
+		return p.t, p.v, p.err
+	}
+	return getDailyMetric(ctx, c.svc, m.Dimensions, *m.MetricName, metricUnits[*m.MetricName], day, c.period)
+}
+
+func (c *collector) collectMetric(ctx context.Context, m *cloudwatch.Metric, day time.Time) []metric {
+	// Get the bucket name, storage type, request metrics filter and
+	// replication rule
+	var name, stype, filterID, ruleID string
+	for _, d := range m.Dimensions {
+		if *d.Name == "BucketName" {
+			name = *d.Value
+		} else if *d.Name == "StorageType" {
+			stype = strings.ToLower(*d.Value)
+			if !c.rawStorage {
+				stype = normalizeStorageType(stype)
+			}
+		} else if *d.Name == "FilterId" {
+			filterID = *d.Value
+		} else if *d.Name == "RuleId" {
+			ruleID = *d.Value
+		}
+	}
+	bname := c.sanitize(name)
+	// Get the bucket size in bytes
+	if *m.MetricName == "BucketSizeBytes" {
+		if c.skipStorage[stype] {
+			return nil
+		}
+		t, v, err := c.getStorage(ctx, m, day)
+		if err != nil {
+			return c.fail(ctx, "failed to get bucket size for bucket %s: %v", name, err)
+		}
+		if t.IsZero() {
+			warnf("bucket size not available for bucket %s", name)
+			return c.skip()
+		}
+		if v < float64(c.minSize) {
+			debugf("skipping size of bucket %s, %s, it is only %.0f bytes", name, stype, v)
+			return nil
+		}
+		out := []metric{{
+			Region: c.region, Bucket: name, Storage: stype, Name: "size", Value: v, Timestamp: t.Unix(),
+			path: c.storagePath(bname, c.sanitize(stype), c.nameOf("size")),
+		}}
+		// And how old it is, if asked for. Datapoints are timestamped with
+		// the start of their period, but cover all of it.
+		if c.age {
+			now := time.Now()
+			age := now.Sub(t.Add(c.period))
+			if age < 0 {
+				age = 0
+			}
+			out = append(out, metric{
+				Region: c.region, Bucket: name, Storage: stype, Name: "age_hours", Value: age.Hours(), Timestamp: now.Unix(),
+				path: c.storagePath(bname, c.sanitize(stype), "age_hours"),
+			})
+		}
+		// And the change since 30 days before, if asked for
+		if c.growth {
+			_, old, err := getDailyMetric(ctx, c.svc, m.Dimensions, *m.MetricName, metricUnits[*m.MetricName], day.AddDate(0, 0, -30), c.period)
+			if err != nil {
+				c.fail(ctx, "failed to get bucket size 30 days ago for bucket %s: %v", name, err)
+			} else if old > 0 {
+				out = append(out, metric{
+					Region: c.region, Bucket: name, Storage: stype, Name: "growth_pct", Value: (v - old) / old * 100, Timestamp: t.Unix(),
+					path: c.storagePath(bname, c.sanitize(stype), "growth_pct"),
+				})
+			}
+		}
+		// And whether it grew by more than the -anomaly-threshold since the
+		// day before
+		if c.anomaly > 0 {
+			pt, prev, err := c.getStorage(ctx, m, day.AddDate(0, 0, -1))
+			if err != nil {
+				c.fail(ctx, "failed to get bucket size the day before for bucket %s: %v", name, err)
+			} else if !pt.IsZero() {
+				// An empty bucket getting its first objects is no anomaly
+				var anomaly float64
+				if prev > 0 && (v-prev)/prev*100 > c.anomaly {
+					anomaly = 1
+				}
+				out = append(out, metric{
+					Region: c.region, Bucket: name, Storage: stype, Name: "anomaly", Value: anomaly, Timestamp: t.Unix(),
+					path: c.storagePath(bname, c.sanitize(stype), "anomaly"),
+				})
+			}
+		}
+		return out
+	}
+	// And the count of objects
+	if *m.MetricName == "NumberOfObjects" {
+		t, v, err := c.getStorage(ctx, m, day)
+		if err != nil {
+			return c.fail(ctx, "failed to get object count for bucket %s: %v", name, err)
+		}
+		if t.IsZero() {
+			warnf("object count not available for bucket %s", name)
+			return c.skip()
+		}
+		path := fmt.Sprintf("%s%s.objcount", c.prefix, bname)
+		if c.objStorage {
+			path = c.storagePath(bname, c.sanitize(stype), "objcount")
+		}
+		return []metric{{
+			Region: c.region, Bucket: name, Storage: stype, Name: "objcount", Value: v, Timestamp: t.Unix(),
+			path: path,
+		}}
+	}
+	// Request metrics, if enabled for the bucket
+	if len(filterID) > 0 && requestMetrics[*m.MetricName] {
+		t, v, err := getRequestMetric(ctx, c.svc, m.Dimensions, *m.MetricName, day)
+		if err != nil {
+			return c.fail(ctx, "failed to get %s for bucket %s, filter %s: %v", *m.MetricName, name, filterID, err)
+		}
+		if t.IsZero() {
+			warnf("%s not available for bucket %s, filter %s", *m.MetricName, name, filterID)
+			return c.skip()
+		}
+		mname := strings.ToLower(*m.MetricName)
+		return []metric{{
+			Region: c.region, Bucket: name, Filter: filterID, Name: mname, Value: v, Timestamp: t.Unix(),
+			path: fmt.Sprintf("%s%s.%s.%s", c.prefix, bname, c.sanitize(filterID), mname),
+		}}
+	}
+
+	// Request latencies, as an average and percentiles
+	if len(filterID) > 0 && latencyMetrics[*m.MetricName] {
+		t, values, err := getLatencyMetric(ctx, c.svc, m.Dimensions, *m.MetricName, day, c.percentiles)
+		if err != nil {
+			return c.fail(ctx, "failed to get %s for bucket %s, filter %s: %v", *m.MetricName, name, filterID, err)
+		}
+		if t.IsZero() {
+			warnf("%s not available for bucket %s, filter %s", *m.MetricName, name, filterID)
+			return c.skip()
+		}
+		mname := strings.ToLower(*m.MetricName)
+		var out []metric
+		for _, stat := range append([]string{"avg"}, c.percentiles...) {
+			v, ok := values[stat]
+			if !ok {
+				continue
+			}
+			out = append(out, metric{
+				Region: c.region, Bucket: name, Filter: filterID, Name: mname, Stat: stat, Value: v, Timestamp: t.Unix(),
+				path: fmt.Sprintf("%s%s.%s.%s.%s", c.prefix, bname, c.sanitize(filterID), mname, statLevel(stat)),
+			})
+		}
+		return out
+	}
+
+	// Replication metrics, for each replication rule
+	if len(ruleID) > 0 {
+		if stat, ok := replicationMetrics[*m.MetricName]; ok {
+			t, v, err := getReplicationMetric(ctx, c.svc, m.Dimensions, *m.MetricName, stat, day)
+			if err != nil {
+				return c.fail(ctx, "failed to get %s for bucket %s, rule %s: %v", *m.MetricName, name, ruleID, err)
+			}
+			if t.IsZero() {
+				warnf("%s not available for bucket %s, rule %s", *m.MetricName, name, ruleID)
+				return c.skip()
+			}
+			mname := strings.ToLower(*m.MetricName)
+			return []metric{{
+				Region: c.region, Bucket: name, Rule: ruleID, Name: mname, Value: v, Timestamp: t.Unix(),
+				path: fmt.Sprintf("%s%s.%s.%s", c.prefix, bname, c.sanitize(ruleID), mname),
+			}}
+		}
+	}
+
+	return nil
+}
+
+// maxDays is the most number of days that can be collected in one go.
+const maxDays = 90
+
+// collectionDays returns the days to collect the metrics of: today,
+// yesterday or the -d date, along with the n-1 days before it if n > 1, or
+// the days from -from to -to.
+func collectionDays(prev bool, date, from, to string, n int) ([]time.Time, error) {
+	if len(from) == 0 && len(to) == 0 {
+		// 0 is the same as 1, when -days isn't given
+		if n < 0 || n > maxDays {
+			return nil, fmt.Errorf("-days must be between 0 and %d", maxDays)
+		}
+		if prev && len(date) > 0 {
+			return nil, errors.New("-1 and -d cannot be used together")
+		}
+		day := time.Now().In(location)
+		if len(date) > 0 {
+			var err error
+			if day, err = parseDate(date); err != nil {
+				return nil, err
+			}
+		} else if prev {
+			day = day.AddDate(0, 0, -1)
+		}
+		days := []time.Time{day}
+		for i := 1; i < n; i++ {
+			days = append([]time.Time{day.AddDate(0, 0, -i)}, days...)
+		}
+		return days, nil
+	}
+
+	if n != 0 {
+		return nil, errors.New("-days cannot be used with -from and -to")
+	}
+	if len(from) == 0 || len(to) == 0 {
+		return nil, errors.New("-from and -to must be given together")
+	}
+	if len(date) > 0 {
+		return nil, errors.New("-d cannot be used with -from and -to")
+	}
+	if prev {
+		return nil, errors.New("-1 cannot be used with -from and -to")
+	}
+	start, err := parseDate(from)
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseDate(to)
+	if err != nil {
+		return nil, err
+	}
+	if start.After(end) {
+		return nil, fmt.Errorf("-from %s is after -to %s", from, to)
+	}
+	var days []time.Time
+	for day := start; !day.After(end); day = day.AddDate(0, 0, 1) {
+		if len(days) == maxDays {
+			return nil, fmt.Errorf("cannot collect more than %d days at a time", maxDays)
+		}
+		days = append(days, day)
+	}
+	return days, nil
+}
+
+func parseDate(s string) (time.Time, error) {
+	t, err := time.ParseInLocation("2006-01-02", s, location)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad date %q, expected YYYY-MM-DD", s)
+	}
+	return t, nil
+}
+
+// taggedPath returns the graphite 1.1 tagged name of the metric, like
+// s3.size;bucket=x;storage=standard;region=us-east-1, with an account tag
+// too if it's given.
+func taggedPath(prefix, account string, m metric) string {
+	tag := func(name, value string) string {
+		if len(value) == 0 {
+			return ""
+		}
+		return ";" + name + "=" + strings.Map(func(r rune) rune {
+			if r == ';' || r == '~' || r == ' ' {
+				return '_'
+			}
+			return r
+		}, value)
+	}
+	return prefix + m.Name + tag("bucket", m.Bucket) + tag("storage", m.Storage) +
+		tag("filter", m.Filter) + tag("rule", m.Rule) + tag("stat", m.Stat) + tag("region", m.Region) +
+		tag("account", account)
+}
+
+// formatValue formats a metric value with as many digits as needed, and
+// without an exponent.
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func writeGraphite(buf *bytes.Buffer, metrics []metric) {
+	for _, m := range metrics {
+		fmt.Fprintf(buf, "%s %s %d\n", m.path, formatValue(m.Value), m.Timestamp)
+	}
+}
+
+// writeStatsD writes the metrics as StatsD gauges, since these are all
+// point-in-time values. StatsD has no notion of timestamps.
+func writeStatsD(buf *bytes.Buffer, metrics []metric) {
+	for _, m := range metrics {
+		fmt.Fprintf(buf, "%s:%s|g\n", m.path, formatValue(m.Value))
+	}
+}
+
+// pickleBatchSize is the number of metrics sent in each pickle message,
+// keeping them well below carbon's 1MB limit.
+const pickleBatchSize = 500
+
+// writePickle writes the metrics as a series of length-prefixed pickled
+// lists of (path, (timestamp, value)) tuples, as expected by carbon's
+// pickle receiver.
+func writePickle(buf *bytes.Buffer, metrics []metric) {
+	for len(metrics) > 0 {
+		n := len(metrics)
+		if n > pickleBatchSize {
+			n = pickleBatchSize
+		}
+		p := &bytes.Buffer{}
+		p.WriteString("\x80\x02") // PROTO 2
+		p.WriteString("](")       // EMPTY_LIST, MARK
+		for _, m := range metrics[:n] {
+			p.WriteByte('X') // BINUNICODE
+			binary.Write(p, binary.LittleEndian, uint32(len(m.path)))
+			p.WriteString(m.path)
+			p.WriteByte('J') // BININT
+			binary.Write(p, binary.LittleEndian, int32(m.Timestamp))
+			p.WriteByte('G') // BINFLOAT
+			binary.Write(p, binary.BigEndian, m.Value)
+			p.WriteString("\x86\x86") // TUPLE2, TUPLE2
+		}
+		p.WriteString("e.") // APPENDS, STOP
+
+		binary.Write(buf, binary.BigEndian, uint32(p.Len()))
+		p.WriteTo(buf)
+		metrics = metrics[n:]
+	}
+}
+
+// promEscaper escapes Prometheus label values.
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writePrometheus writes the metrics in the Prometheus text exposition
+// format, suitable for node_exporter's textfile collector.
+func writePrometheus(buf *bytes.Buffer, metrics []metric) {
+	byName := make(map[string][]metric)
+	var names []string
+	for _, m := range metrics {
+		var name string
+		switch m.Name {
+		case "size":
+			name = "s3_bucket_size_bytes"
+		case "objcount":
+			name = "s3_bucket_objects"
+		default:
+			name = "s3_bucket_" + m.Name
+		}
+		if _, ok := byName[name]; !ok {
+			names = append(names, name)
+		}
+		byName[name] = append(byName[name], m)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(buf, "# TYPE %s gauge\n", name)
+		// Only the latest of each series, when several days were collected,
+		// since the same series can't be given more than once
+		latest := make(map[string]metric)
+		var series []string
+		for _, m := range byName[name] {
+			labels := fmt.Sprintf(`region="%s",bucket="%s"`, promEscaper.Replace(m.Region), promEscaper.Replace(m.Bucket))
+			if len(m.Storage) > 0 {
+				labels += fmt.Sprintf(`,storage="%s"`, promEscaper.Replace(m.Storage))
+			}
+			if len(m.Filter) > 0 {
+				labels += fmt.Sprintf(`,filter="%s"`, promEscaper.Replace(m.Filter))
+			}
+			if len(m.Rule) > 0 {
+				labels += fmt.Sprintf(`,rule="%s"`, promEscaper.Replace(m.Rule))
+			}
+			if len(m.Stat) > 0 {
+				labels += fmt.Sprintf(`,stat="%s"`, promEscaper.Replace(m.Stat))
+			}
+			last, ok := latest[labels]
+			if !ok {
+				series = append(series, labels)
+			}
+			if !ok || m.Timestamp >= last.Timestamp {
+				latest[labels] = m
+			}
+		}
+		for _, labels := range series {
+			fmt.Fprintf(buf, "%s{%s} %s\n", name, labels, formatValue(latest[labels].Value))
+		}
+	}
+}
+
+// metricsHandler serves the metrics in the Prometheus format, collecting
+// them afresh when they are older than ttl.
+type metricsHandler struct {
+	ttl     time.Duration
+	collect func(ctx context.Context) ([]metric, error)
+
+	mu   sync.Mutex
+	last time.Time
+	data []byte
+}
+
+func (h *metricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.last.IsZero() || time.Since(h.last) >= h.ttl {
+		metrics, err := h.collect(r.Context())
+		if err != nil {
+			errorf("%v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		buf := &bytes.Buffer{}
+		writePrometheus(buf, metrics)
+		h.data, h.last = buf.Bytes(), time.Now()
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(h.data)
+}
+
 var (
-	accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
-	secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
-	awsRegion = os.Getenv("AWS_REGION")
+	influxEscaper      = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
 )
 
-func main() {
-	log.SetFlags(0)
+// writeInflux writes the metrics in the InfluxDB line protocol, with the
+// bucket, storage type and so on as tags.
+func writeInflux(buf *bytes.Buffer, metrics []metric, measurement, extraTags string) {
+	for _, m := range metrics {
+		buf.WriteString(measurementEscaper.Replace(measurement))
+		fmt.Fprintf(buf, ",region=%s,bucket=%s", influxEscaper.Replace(m.Region), influxEscaper.Replace(m.Bucket))
+		if len(m.Storage) > 0 {
+			fmt.Fprintf(buf, ",storage=%s", influxEscaper.Replace(m.Storage))
+		}
+		if len(m.Filter) > 0 {
+			fmt.Fprintf(buf, ",filter=%s", influxEscaper.Replace(m.Filter))
+		}
+		if len(m.Rule) > 0 {
+			fmt.Fprintf(buf, ",rule=%s", influxEscaper.Replace(m.Rule))
+		}
+		if len(m.Stat) > 0 {
+			fmt.Fprintf(buf, ",stat=%s", m.Stat)
+		}
+		buf.WriteString(extraTags)
+		fmt.Fprintf(buf, " %s=%s %d\n", m.Name, formatValue(m.Value), m.Timestamp*int64(time.Second))
+	}
+}
+
+// writeOpenTSDB writes the metrics as OpenTSDB telnet-style put commands,
+// with the bucket, storage type and so on as tags.
+func writeOpenTSDB(buf *bytes.Buffer, metrics []metric) {
+	for _, m := range metrics {
+		fmt.Fprintf(buf, "put s3.bucket.%s %d %s region=%s bucket=%s", m.Name, m.Timestamp, formatValue(m.Value),
+			tsdbSanitize(m.Region), tsdbSanitize(m.Bucket))
+		if len(m.Storage) > 0 {
+			fmt.Fprintf(buf, " storage=%s", tsdbSanitize(m.Storage))
+		}
+		if len(m.Filter) > 0 {
+			fmt.Fprintf(buf, " filter=%s", tsdbSanitize(m.Filter))
+		}
+		if len(m.Rule) > 0 {
+			fmt.Fprintf(buf, " rule=%s", tsdbSanitize(m.Rule))
+		}
+		if len(m.Stat) > 0 {
+			fmt.Fprintf(buf, " stat=%s", m.Stat)
+		}
+		buf.WriteByte('\n')
+	}
+}
+
+// tsdbSanitize replaces the characters that OpenTSDB does not allow in tag
+// values with '_'.
+func tsdbSanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == '_' || r == '.' || r == '/' || unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return '_'
+	}, s)
+}
 
-	// Check env. vars.
-	if len(accessKey) == 0 || len(secretKey) == 0 || len(awsRegion) == 0 {
-		log.Fatal("Please set the environment variables AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_REGION")
+func writeJSON(buf *bytes.Buffer, metrics []metric) {
+	enc := json.NewEncoder(buf)
+	for _, m := range metrics {
+		enc.Encode(m)
 	}
+}
 
-	// Check command line args.
-	prefixDefault := "s3." + awsRegion + "."
-	prefix := flag.String("p", prefixDefault, "`prefix` for graphite metrics names")
-	prev := flag.Bool("1", false, "collect yesterday's metrics rather than today's")
-	addr := flag.String("g", "127.0.0.1:2003", "`graphite server` to send metrics to")
-	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "s3report - Collects today's S3 metrics and reports them to Graphite\n")
-		flag.PrintDefaults()
+// storageSummary is the -summary report of the storage used in each region.
+type storageSummary struct {
+	Timestamp int64           `json:"timestamp"`
+	Regions   []regionSummary `json:"regions"`
+}
+
+type regionSummary struct {
+	Region      string             `json:"region"`
+	BucketCount int64              `json:"bucketcount"`
+	Storage     map[string]float64 `json:"storage"` // size of all buckets, by storage type
+	Buckets     []bucketSummary    `json:"buckets"`
+}
+
+type bucketSummary struct {
+	Bucket   string             `json:"bucket"`
+	Size     map[string]float64 `json:"size"` // by storage type
+	Objcount float64            `json:"objcount"`
+}
+
+// summarize makes the -summary report from the latest storage metrics of
+// each bucket.
+func summarize(metrics []metric) storageSummary {
+	type key struct {
+		region, bucket, name, storage string
 	}
-	flag.Parse()
-	tcpAddr, err := net.ResolveTCPAddr("tcp", *addr)
+	latest := make(map[key]metric)
+	counts := make(map[string]int64)
+	for _, m := range metrics {
+		if m.Bucket == "_meta" && m.Name == "bucketcount" {
+			counts[m.Region] = int64(m.Value)
+		}
+		// The totals are worked out again below
+		if !isStorageMetric(m) || m.Bucket == "_total" || m.Storage == "total" {
+			continue
+		}
+		k := key{m.Region, m.Bucket, m.Name, m.Storage}
+		if last, ok := latest[k]; !ok || m.Timestamp > last.Timestamp {
+			latest[k] = m
+		}
+	}
+
+	regions := make(map[string]*regionSummary)
+	buckets := make(map[[2]string]*bucketSummary)
+	for k, m := range latest {
+		r, ok := regions[k.region]
+		if !ok {
+			r = &regionSummary{Region: k.region, BucketCount: counts[k.region], Storage: make(map[string]float64)}
+			regions[k.region] = r
+		}
+		b, ok := buckets[[2]string{k.region, k.bucket}]
+		if !ok {
+			b = &bucketSummary{Bucket: k.bucket, Size: make(map[string]float64)}
+			buckets[[2]string{k.region, k.bucket}] = b
+		}
+		if m.Name == "size" {
+			b.Size[m.Storage] += m.Value
+			r.Storage[m.Storage] += m.Value
+		} else {
+			b.Objcount += m.Value
+		}
+	}
+	for k, b := range buckets {
+		r := regions[k[0]]
+		r.Buckets = append(r.Buckets, *b)
+	}
+
+	s := storageSummary{Timestamp: time.Now().Unix(), Regions: []regionSummary{}}
+	for _, r := range regions {
+		sort.Slice(r.Buckets, func(i, j int) bool { return r.Buckets[i].Bucket < r.Buckets[j].Bucket })
+		s.Regions = append(s.Regions, *r)
+	}
+	sort.Slice(s.Regions, func(i, j int) bool { return s.Regions[i].Region < s.Regions[j].Region })
+	return s
+}
+
+// writeFile writes data to the file at path. Unless appending, the data is
+// written to a temporary file first and renamed into place, so readers never
+// see a partially written file.
+func writeFile(path string, appendTo bool, data []byte) error {
+	if appendTo {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(data); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
 	if err != nil {
-		log.Fatal(err.Error())
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
 	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
 
-	// Create CloudWatch service
-	svc := cloudwatch.New(session.New())
+// newSession creates a session for the profile, or the default one. The
+// region is taken from the shared config file too, as the AWS CLI does.
+func newSession(profile string) (*session.Session, error) {
+	return session.NewSessionWithOptions(session.Options{
+		Profile:           profile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+}
 
-	// List all metrics in the AWS/S3 namespace
-	params := &cloudwatch.ListMetricsInput{
-		Namespace: aws.String("AWS/S3"),
+// accountID returns the ID of the AWS account that the credentials are for.
+func accountID(sess *session.Session, creds *credentials.Credentials) (string, error) {
+	resp, err := sts.New(sess, &aws.Config{Credentials: creds}).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(resp.Account), nil
+}
+
+// isTerminal reports whether f is a terminal, rather than a file or a pipe.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// splitList splits a comma-separated flag value, ignoring empty items.
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func formatSize(n int) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fMB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fKB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", n)
+}
+
+func isFlagSet(name string) (set bool) {
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return
+}
+
+// maxDatagramSize is the largest UDP payload we send in one go, chosen to fit
+// within a typical ethernet MTU.
+const maxDatagramSize = 1400
+
+// sender sends metrics to a graphite, or similar, server.
+type sender struct {
+	addr      string
+	udp       bool
+	timeout   time.Duration
+	tlsConfig *tls.Config
+	batch     int // lines per write over TCP, 0 for all at once
+	retries   int // times to try sending again if it fails
+}
+
+// dial connects to the server. The address is only looked up here, so that a
+// bad one doesn't get in the way of a -dry-run or the other outputs.
+func (s *sender) dial() (net.Conn, error) {
+	if path := strings.TrimPrefix(s.addr, "unix://"); path != s.addr {
+		// A local server listening on a unix socket
+		if s.udp {
+			return net.DialTimeout("unixgram", path, s.timeout)
+		}
+		return net.DialTimeout("unix", path, s.timeout)
 	}
-	resp, err := svc.ListMetrics(params)
+	if s.udp {
+		return net.DialTimeout("udp", s.addr, s.timeout)
+	} else if s.tlsConfig != nil {
+		return tls.DialWithDialer(&net.Dialer{Timeout: s.timeout}, "tcp", s.addr, s.tlsConfig)
+	}
+	return net.DialTimeout("tcp", s.addr, s.timeout)
+}
+
+func (s *sender) write(conn net.Conn, data []byte) error {
+	if s.timeout > 0 {
+		if err := conn.SetWriteDeadline(time.Now().Add(s.timeout)); err != nil {
+			return err
+		}
+	}
+	_, err := conn.Write(data)
+	return err
+}
+
+// send sends the data, trying again up to s.retries times, backing off a
+// little more each time.
+func (s *sender) send(ctx context.Context, data []byte) error {
+	err := s.sendOnce(data)
+	for i := 0; err != nil && i < s.retries; i++ {
+		backoff := time.Duration(1<<uint(i)) * time.Second
+		warnf("failed to send to %s, trying again in %v: %v", s.addr, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		err = s.sendOnce(data)
+	}
+	return err
+}
+
+func (s *sender) sendOnce(data []byte) error {
+	conn, err := s.dial()
 	if err != nil {
-		log.Fatal(err.Error())
+		return err
 	}
+	defer func() { conn.Close() }()
 
-	// For each metric..
-	buf := &bytes.Buffer{}
-	for _, m := range resp.Metrics {
-		// Get the bucket name and storage type
-		var name, stype string
-		for _, d := range m.Dimensions {
-			if *d.Name == "BucketName" {
-				name = *d.Value
-			} else if *d.Name == "StorageType" {
-				stype = strings.ToLower(*d.Value)
+	for len(data) > 0 {
+		var n int
+		if s.udp {
+			// Split into datagrams on line boundaries so that no metric is
+			// cut in two
+			n = len(data)
+			if n > maxDatagramSize {
+				n = bytes.LastIndexByte(data[:maxDatagramSize], '\n') + 1
+				if n == 0 {
+					n = maxDatagramSize
+				}
 			}
+		} else {
+			n = batchEnd(data, s.batch)
 		}
-		// Get the bucket size in bytes
-		if *m.MetricName == "BucketSizeBytes" {
-			t, v := getBucketSize(svc, m.Dimensions, *prev)
-			if t.IsZero() {
-				log.Printf("bucket size not available for bucket %s", name)
-			} else {
-				fmt.Fprintf(buf, "%s%s.%s.size %d %d\n", *prefix, name, stype, v, t.Unix())
+		if err := s.write(conn, data[:n]); err != nil {
+			if s.udp {
+				return err
 			}
-		}
-		// And the count of objects
-		if *m.MetricName == "NumberOfObjects" {
-			t, v := getBucketObjectCount(svc, m.Dimensions, *prev)
-			if t.IsZero() {
-				log.Printf("object count not available for bucket %s", name)
-			} else {
-				fmt.Fprintf(buf, "%s%s.objcount %d %d\n", *prefix, name, v, t.Unix())
+			// Reconnect and send the batch again. Some of it may have got
+			// through, but graphite keeps only one value per timestamp.
+			conn.Close()
+			if conn, err = s.dial(); err != nil {
+				return err
+			}
+			if err := s.write(conn, data[:n]); err != nil {
+				return err
 			}
 		}
+		data = data[n:]
 	}
+	return nil
+}
+
+// batchEnd returns the length of the first batch of lines in data.
+func batchEnd(data []byte, lines int) int {
+	if lines <= 0 {
+		return len(data)
+	}
+	n := 0
+	for i := 0; i < lines; i++ {
+		j := bytes.IndexByte(data[n:], '\n')
+		if j < 0 {
+			return len(data)
+		}
+		n += j + 1
+	}
+	return n
+}
+
+func postMetrics(url string, timeout time.Duration, data []byte) error {
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Post(url, "text/plain; charset=utf-8", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s: %s", url, resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// bucketMetrics returns the standard storage size and object count metrics of
+// the buckets, as ListMetrics would.
+func bucketMetrics(buckets []string) []*cloudwatch.Metric {
+	var metrics []*cloudwatch.Metric
+	for _, b := range buckets {
+		for _, m := range [][2]string{{"BucketSizeBytes", "StandardStorage"}, {"NumberOfObjects", "AllStorageTypes"}} {
+			metrics = append(metrics, &cloudwatch.Metric{
+				Namespace:  aws.String(namespace),
+				MetricName: aws.String(m[0]),
+				Dimensions: []*cloudwatch.Dimension{
+					{Name: aws.String("BucketName"), Value: aws.String(b)},
+					{Name: aws.String("StorageType"), Value: aws.String(m[1])},
+				},
+			})
+		}
+	}
+	return metrics
+}
 
-	if buf.Len() > 0 {
-		fmt.Print(buf.String())
-		fmt.Printf("sending to graphite server at %v:\n", tcpAddr)
-		conn, err := net.DialTCP("tcp", nil, tcpAddr)
+func listMetrics(ctx context.Context, svc *cloudwatch.CloudWatch) ([]*cloudwatch.Metric, error) {
+	params := &cloudwatch.ListMetricsInput{
+		Namespace: aws.String(namespace),
+	}
+	var metrics []*cloudwatch.Metric
+	for {
+		resp, err := svc.ListMetricsWithContext(ctx, params)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
-		buf.WriteTo(conn)
-		conn.Close()
-		fmt.Println("done.")
-	} else {
-		log.Println("No metrics were found for today.")
-		log.Println("Try running it later in the day or run with \"-1\" flag.")
+		metrics = append(metrics, resp.Metrics...)
+		// Keep going until there are no more pages
+		if resp.NextToken == nil {
+			break
+		}
+		params.NextToken = resp.NextToken
 	}
+
+	return metrics, nil
 }
 
-func getBucketSize(svc *cloudwatch.CloudWatch, dims []*cloudwatch.Dimension, prev bool) (time.Time, int64) {
-	t := time.Now().In(time.UTC)
-	if prev {
-		t = t.Add(-24 * time.Hour)
+// storagePoint is the value of a storage metric fetched with GetMetricData.
+type storagePoint struct {
+	t   time.Time
+	v   float64
+	err error
+}
+
+// maxMetricDataQueries is the most queries a GetMetricData call can have.
+const maxMetricDataQueries = 500
+
+func fetchKey(m *cloudwatch.Metric, day time.Time) string {
+	return metricKey(m) + "," + day.Format("2006-01-02")
+}
+
+// fetchStorage gets the latest values of the given storage metrics for the
+// day, in batches of GetMetricData queries.
+func (c *collector) fetchStorage(ctx context.Context, metrics []*cloudwatch.Metric, day time.Time) {
+	// Storage metrics are reported once a day, at some point during the day
+	st, et := dayWindow(day)
+	for len(metrics) > 0 {
+		batch := metrics
+		if len(batch) > maxMetricDataQueries {
+			batch = batch[:maxMetricDataQueries]
+		}
+		metrics = metrics[len(batch):]
+
+		params := &cloudwatch.GetMetricDataInput{
+			StartTime: aws.Time(st),
+			EndTime:   aws.Time(et),
+		}
+		for i, m := range batch {
+			params.MetricDataQueries = append(params.MetricDataQueries, &cloudwatch.MetricDataQuery{
+				Id: aws.String(fmt.Sprintf("m%d", i)),
+				MetricStat: &cloudwatch.MetricStat{
+					Metric: m,
+					Period: aws.Int64(int64(c.period / time.Second)),
+					Stat:   aws.String("Average"),
+					Unit:   aws.String(metricUnits[*m.MetricName]),
+				},
+			})
+		}
+
+		// The datapoints of a query can be spread over several pages
+		latest := make(map[string]storagePoint)
+		var err error
+		for {
+			var resp *cloudwatch.GetMetricDataOutput
+			resp, err = c.svc.GetMetricDataWithContext(ctx, params)
+			if err != nil {
+				break
+			}
+			for _, r := range resp.MetricDataResults {
+				p := latest[*r.Id]
+				for i, t := range r.Timestamps {
+					if t.After(p.t) {
+						p.t, p.v = *t, *r.Values[i]
+					}
+				}
+				latest[*r.Id] = p
+			}
+			if resp.NextToken == nil {
+				break
+			}
+			params.NextToken = resp.NextToken
+		}
+		for i, m := range batch {
+			p := latest[fmt.Sprintf("m%d", i)]
+			p.err = err
+			c.fetched[fetchKey(m, day)] = p
+		}
+	}
+}
+
+// getDailyMetric gets a storage metric, which is reported once a day, at some
+// point during the day.
+func getDailyMetric(ctx context.Context, svc *cloudwatch.CloudWatch, dims []*cloudwatch.Dimension, name, unit string, day time.Time, period time.Duration) (time.Time, float64, error) {
+	return getMetric(ctx, svc, dims, name, unit, "Average", day, period)
+}
+
+func getRequestMetric(ctx context.Context, svc *cloudwatch.CloudWatch, dims []*cloudwatch.Dimension, name string, day time.Time) (time.Time, float64, error) {
+	// Request metrics are reported every minute, so sum them over the day
+	return getMetric(ctx, svc, dims, name, metricUnits[name], "Sum", day, 24*time.Hour)
+}
+
+func getReplicationMetric(ctx context.Context, svc *cloudwatch.CloudWatch, dims []*cloudwatch.Dimension, name, stat string, day time.Time) (time.Time, float64, error) {
+	return getMetric(ctx, svc, dims, name, metricUnits[name], stat, day, 24*time.Hour)
+}
+
+// dayWindow returns the start and end of the day in -tz, up to now for today
+// so that whatever has been published so far is included.
+func dayWindow(day time.Time) (time.Time, time.Time) {
+	y, m, d := day.Date()
+	st := time.Date(y, m, d, 0, 0, 0, 0, location)
+	et := st.AddDate(0, 0, 1)
+	if now := time.Now(); now.After(st) && now.Before(et) {
+		et = now
 	}
-	y, m, d := t.Date()
-	st := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
-	et := time.Date(y, m, d, 0, 1, 0, 0, time.UTC)
+	return st, et
+}
+
+// startOfDay returns the start of the day in -tz that the unix timestamp is
+// in.
+func startOfDay(ts int64) int64 {
+	y, m, d := time.Unix(ts, 0).In(location).Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, location).Unix()
+}
+
+// getMetric gets the latest value of a statistic of the metric on the day.
+// The unit, if not empty, has to be the one the metric is published with,
+// or CloudWatch returns no datapoints at all.
+func getMetric(ctx context.Context, svc *cloudwatch.CloudWatch, dims []*cloudwatch.Dimension, name, unit, stat string, day time.Time, period time.Duration) (time.Time, float64, error) {
+	st, et := dayWindow(day)
 	params := &cloudwatch.GetMetricStatisticsInput{
 		StartTime:  aws.Time(st),
 		EndTime:    aws.Time(et),
-		Period:     aws.Int64(60),
-		MetricName: aws.String("BucketSizeBytes"),
-		Namespace:  aws.String("AWS/S3"),
+		Period:     aws.Int64(int64(period / time.Second)),
+		MetricName: aws.String(name),
+		Namespace:  aws.String(namespace),
 		Statistics: []*string{
-			aws.String("Average"),
+			aws.String(stat),
 		},
 		Dimensions: dims,
-		Unit:       aws.String("Bytes"),
+	}
+	if len(unit) > 0 {
+		params.Unit = aws.String(unit)
 	}
 
-	return actualGet(svc, params)
+	return actualGet(ctx, svc, params)
 }
 
-func getBucketObjectCount(svc *cloudwatch.CloudWatch, dims []*cloudwatch.Dimension, prev bool) (time.Time, int64) {
-	t := time.Now().In(time.UTC)
-	if prev {
-		t = t.Add(-24 * time.Hour)
-	}
-	y, m, d := t.Date()
-	st := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
-	et := time.Date(y, m, d, 0, 1, 0, 0, time.UTC)
+func getLatencyMetric(ctx context.Context, svc *cloudwatch.CloudWatch, dims []*cloudwatch.Dimension, name string, day time.Time, percentiles []string) (time.Time, map[string]float64, error) {
+	st, et := dayWindow(day)
 	params := &cloudwatch.GetMetricStatisticsInput{
 		StartTime:  aws.Time(st),
 		EndTime:    aws.Time(et),
-		Period:     aws.Int64(60),
-		MetricName: aws.String("NumberOfObjects"),
-		Namespace:  aws.String("AWS/S3"),
+		Period:     aws.Int64(86400),
+		MetricName: aws.String(name),
+		Namespace:  aws.String(namespace),
 		Statistics: []*string{
 			aws.String("Average"),
 		},
 		Dimensions: dims,
-		Unit:       aws.String("Count"),
+		Unit:       aws.String(metricUnits[name]),
+	}
+	dp, err := latestDatapoint(ctx, svc, params)
+	if err != nil || dp == nil {
+		return time.Time{}, nil, err
+	}
+	values := map[string]float64{"avg": *dp.Average}
+
+	// Percentiles can't be asked for along with the other statistics
+	if len(percentiles) > 0 {
+		params.Statistics = nil
+		params.ExtendedStatistics = aws.StringSlice(percentiles)
+		pdp, err := latestDatapoint(ctx, svc, params)
+		if err != nil {
+			return time.Time{}, nil, err
+		}
+		if pdp != nil {
+			for k, v := range pdp.ExtendedStatistics {
+				values[k] = *v
+			}
+		}
 	}
+	return *dp.Timestamp, values, nil
+}
 
-	return actualGet(svc, params)
+func actualGet(ctx context.Context, svc *cloudwatch.CloudWatch, params *cloudwatch.GetMetricStatisticsInput) (time.Time, float64, error) {
+	dp, err := latestDatapoint(ctx, svc, params)
+	if err != nil || dp == nil {
+		return time.Time{}, 0, err
+	}
+	switch *params.Statistics[0] {
+	case "Sum":
+		return *dp.Timestamp, *dp.Sum, nil
+	case "Maximum":
+		return *dp.Timestamp, *dp.Maximum, nil
+	}
+	return *dp.Timestamp, *dp.Average, nil
 }
 
-func actualGet(svc *cloudwatch.CloudWatch, params *cloudwatch.GetMetricStatisticsInput) (time.Time, int64) {
-	resp, err := svc.GetMetricStatistics(params)
+func latestDatapoint(ctx context.Context, svc *cloudwatch.CloudWatch, params *cloudwatch.GetMetricStatisticsInput) (*cloudwatch.Datapoint, error) {
+	resp, err := svc.GetMetricStatisticsWithContext(ctx, params)
 	if err != nil {
-		log.Fatal(err.Error())
+		return nil, err
 	}
 	if len(resp.Datapoints) == 0 {
-		return time.Time{}, 0
+		return nil, nil
+	}
+
+	// Datapoints are not necessarily in order; use the latest one
+	dp := resp.Datapoints[0]
+	for _, p := range resp.Datapoints[1:] {
+		if p.Timestamp.After(*dp.Timestamp) {
+			dp = p
+		}
+	}
+	return dp, nil
+}
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"DEBUG", "INFO", "WARN", "ERROR"}
+
+var minLogLevel = levelInfo
+
+func setLogLevel(name string) error {
+	for i, n := range levelNames {
+		if strings.EqualFold(n, name) {
+			minLogLevel = logLevel(i)
+			return nil
+		}
 	}
+	return fmt.Errorf("unknown log level %q", name)
+}
 
-	return *resp.Datapoints[0].Timestamp, int64(*resp.Datapoints[0].Average)
+func logf(level logLevel, format string, args ...interface{}) {
+	if level >= minLogLevel {
+		log.Printf(levelNames[level]+" "+format, args...)
+	}
 }
+
+func debugf(format string, args ...interface{}) { logf(levelDebug, format, args...) }
+func infof(format string, args ...interface{})  { logf(levelInfo, format, args...) }
+func warnf(format string, args ...interface{})  { logf(levelWarn, format, args...) }
+func errorf(format string, args ...interface{}) { logf(levelError, format, args...) }